@@ -21,24 +21,104 @@ package psiphon
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"strconv"
 	"sync"
 	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/notice"
 )
 
 var noticeLoggerMutex sync.Mutex
 var noticeLogger = log.New(os.Stderr, "", 0)
+var noticeLevel = NoticeLevelInfo
+var noticeRedactionUnsafe = false
+
+// NoticeLevel indicates the severity of a notice, allowing consumers to
+// filter verbose output or surface additional debug diagnostics without
+// recompiling.
+type NoticeLevel int32
+
+const (
+	NoticeLevelDebug NoticeLevel = iota
+	NoticeLevelInfo
+	NoticeLevelWarning
+	NoticeLevelError
+)
+
+// String returns the JSON representation of a NoticeLevel.
+func (level NoticeLevel) String() string {
+	switch level {
+	case NoticeLevelDebug:
+		return "Debug"
+	case NoticeLevelInfo:
+		return "Info"
+	case NoticeLevelWarning:
+		return "Warning"
+	case NoticeLevelError:
+		return "Error"
+	}
+	return "Info"
+}
+
+// SetNoticeLevel sets the minimum level a notice must have to be emitted.
+// Notices below this level are dropped before JSON marshaling. By default,
+// the notice level is NoticeLevelInfo, so NoticeDebug output is suppressed
+// unless explicitly enabled.
+func SetNoticeLevel(level NoticeLevel) {
+	noticeLoggerMutex.Lock()
+	defer noticeLoggerMutex.Unlock()
+	noticeLevel = level
+}
+
+// privateValue wraps a notice argument that is considered private, such as
+// a server IP address, a user-visited address, or a sponsor URL. Notice*
+// functions tag such arguments with noticePrivate so outputNotice can
+// redact them when not in unsafe diagnostics mode.
+type privateValue struct {
+	value interface{}
+}
+
+// noticePrivate tags a notice argument value as private.
+func noticePrivate(value interface{}) privateValue {
+	return privateValue{value: value}
+}
+
+// SetNoticeRedactionMode sets whether private notice fields -- such as
+// server IPs, user-visited addresses, and sponsor URLs -- are redacted
+// before being emitted. By default, redaction mode is "safe": private
+// fields are replaced with a stable, non-reversible hash. When unsafe is
+// true, "unsafe diagnostics" mode is enabled and private fields are
+// emitted verbatim.
+//
+// Redaction mode should remain "safe" for any notice output that may be
+// pasted into a bug report or otherwise shared; "unsafe diagnostics" mode
+// is intended for local debugging only.
+func SetNoticeRedactionMode(unsafe bool) {
+	noticeLoggerMutex.Lock()
+	defer noticeLoggerMutex.Unlock()
+	noticeRedactionUnsafe = unsafe
+}
+
+// redactValue returns a stable, non-reversible placeholder for a private
+// notice value, allowing occurrences of the same value to be correlated
+// without revealing it.
+func redactValue(value interface{}) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%v", value)))
+	return fmt.Sprintf("[redacted:%x]", hash[:8])
+}
 
 // SetNoticeOutput sets a target writer to receive notices. By default,
 // notices are written to stderr.
 //
 // Notices are encoded in JSON. Here's an example:
 //
-// {"data":{"message":"shutdown operate tunnel"},"noticeType":"Info","showUser":false,"timestamp":"2015-01-28T17:35:13Z"}
+// {"data":{"message":"shutdown operate tunnel"},"level":"Info","noticeType":"Info","showUser":false,"timestamp":"2015-01-28T17:35:13Z"}
 //
 // All notices have the following fields:
 // - "noticeType": the type of notice, which indicates the meaning of the notice along with what's in the data payload.
@@ -48,6 +128,7 @@ var noticeLogger = log.New(os.Stderr, "", 0)
 // as the user should be informed that their configured choice of listening port could not be used. Core clients should
 // anticipate that the core will add additional "showUser"=true notices in the future and emit at least the raw notice.
 // - "timestamp": UTC timezone, RFC3339 format timestamp for notice event
+// - "level": the notice's severity -- one of "Debug", "Info", "Warning", "Error" -- see SetNoticeLevel.
 //
 // See the Notice* functions for details on each notice meaning and payload.
 //
@@ -57,11 +138,21 @@ func SetNoticeOutput(output io.Writer) {
 	noticeLogger = log.New(output, "", 0)
 }
 
-// outputNotice encodes a notice in JSON and writes it to the output writer.
-func outputNotice(noticeType string, showUser bool, args ...interface{}) {
+// outputNotice encodes a notice in JSON and writes it to the output writer,
+// after checking that its level meets the configured notice level.
+func outputNotice(noticeType string, level NoticeLevel, showUser bool, args ...interface{}) {
+	noticeLoggerMutex.Lock()
+	gateLevel := noticeLevel
+	redactionUnsafe := noticeRedactionUnsafe
+	noticeLoggerMutex.Unlock()
+	if level < gateLevel {
+		return
+	}
+
 	obj := make(map[string]interface{})
 	noticeData := make(map[string]interface{})
 	obj["noticeType"] = noticeType
+	obj["level"] = level.String()
 	obj["showUser"] = showUser
 	obj["data"] = noticeData
 	obj["timestamp"] = time.Now().UTC().Format(time.RFC3339)
@@ -69,7 +160,15 @@ func outputNotice(noticeType string, showUser bool, args ...interface{}) {
 		name, ok := args[i].(string)
 		value := args[i+1]
 		if ok {
-			noticeData[name] = value
+			if private, isPrivate := value.(privateValue); isPrivate {
+				if redactionUnsafe {
+					noticeData[name] = private.value
+				} else {
+					noticeData[name] = redactValue(private.value)
+				}
+			} else {
+				noticeData[name] = value
+			}
 		}
 	}
 	encodedJson, err := json.Marshal(obj)
@@ -80,132 +179,211 @@ func outputNotice(noticeType string, showUser bool, args ...interface{}) {
 		output = fmt.Sprintf("{\"Alert\":{\"message\":\"%s\"}}", ContextError(err))
 	}
 	noticeLoggerMutex.Lock()
-	defer noticeLoggerMutex.Unlock()
 	noticeLogger.Print(output)
+	noticeLoggerMutex.Unlock()
+
+	dispatchToHTTPSink(noticeType, output)
+	cacheNoticeForDiagnostics(noticeType, output)
+}
+
+// outputTypedNotice encodes a notice using a concrete notice.Payload's
+// own MarshalJSON, rather than building a map[string]interface{} and
+// relying on encoding/json's reflection-based encoder. This is the fast
+// path for high-frequency notices -- e.g. Tunnels transitions, CoreVersion,
+// the Info/Alert/Error/Debug message notices -- and is used in place of
+// outputNotice wherever the notice's fields don't require redaction (see
+// SetNoticeRedactionMode; redacted fields still go through outputNotice,
+// since redaction has to happen per-field before marshaling).
+func outputTypedNotice(level NoticeLevel, showUser bool, payload notice.Payload) {
+	noticeLoggerMutex.Lock()
+	gateLevel := noticeLevel
+	noticeLoggerMutex.Unlock()
+	if level < gateLevel {
+		return
+	}
+
+	data, err := payload.MarshalJSON()
+	if err != nil {
+		// Logged directly, rather than via NoticeError, since NoticeError
+		// itself now goes through outputTypedNotice.
+		noticeLoggerMutex.Lock()
+		noticeLogger.Print(fmt.Sprintf("{\"Alert\":{\"message\":\"%s\"}}", ContextError(err)))
+		noticeLoggerMutex.Unlock()
+		return
+	}
+
+	buf := make([]byte, 0, 80+len(data)+len(payload.NoticeType()))
+	buf = append(buf, `{"data":`...)
+	buf = append(buf, data...)
+	buf = append(buf, `,"level":"`...)
+	buf = append(buf, level.String()...)
+	buf = append(buf, `","noticeType":"`...)
+	buf = append(buf, payload.NoticeType()...)
+	buf = append(buf, `","showUser":`...)
+	buf = strconv.AppendBool(buf, showUser)
+	buf = append(buf, `,"timestamp":"`...)
+	buf = append(buf, time.Now().UTC().Format(time.RFC3339)...)
+	buf = append(buf, `"}`...)
+
+	output := string(buf)
+
+	noticeLoggerMutex.Lock()
+	noticeLogger.Print(output)
+	noticeLoggerMutex.Unlock()
+
+	dispatchToHTTPSink(payload.NoticeType(), output)
+	cacheNoticeForDiagnostics(payload.NoticeType(), output)
+}
+
+// NoticeDebug is a debug message; only emitted when the notice level is
+// set to NoticeLevelDebug
+func NoticeDebug(format string, args ...interface{}) {
+	outputTypedNotice(NoticeLevelDebug, false, notice.NewMessagePayload("Debug", fmt.Sprintf(format, args...)))
 }
 
 // NoticeInfo is an informational message
 func NoticeInfo(format string, args ...interface{}) {
-	outputNotice("Info", false, "message", fmt.Sprintf(format, args...))
+	outputTypedNotice(NoticeLevelInfo, false, notice.NewMessagePayload("Info", fmt.Sprintf(format, args...)))
 }
 
 // NoticeInfo is an alert message; typically a recoverable error condition
 func NoticeAlert(format string, args ...interface{}) {
-	outputNotice("Alert", false, "message", fmt.Sprintf(format, args...))
+	outputTypedNotice(NoticeLevelWarning, false, notice.NewMessagePayload("Alert", fmt.Sprintf(format, args...)))
 }
 
 // NoticeInfo is an error message; typically an unrecoverable error condition
 func NoticeError(format string, args ...interface{}) {
-	outputNotice("Error", true, "message", fmt.Sprintf(format, args...))
+	outputTypedNotice(NoticeLevelError, true, notice.NewMessagePayload("Error", fmt.Sprintf(format, args...)))
 }
 
 // NoticeCoreVersion is the version string of the core
 func NoticeCoreVersion(version string) {
-	outputNotice("CoreVersion", false, "version", version)
+	outputTypedNotice(NoticeLevelInfo, false, notice.CoreVersionPayload{Version: version})
 }
 
 // NoticeCandidateServers is how many possible servers are available for the selected region and protocol
 func NoticeCandidateServers(region, protocol string, count int) {
-	outputNotice("CandidateServers", false, "region", region, "protocol", protocol, "count", count)
+	outputTypedNotice(NoticeLevelInfo, false, notice.CandidateServersPayload{Region: region, Protocol: protocol, Count: count})
 }
 
 // NoticeConnectingServer is details on a connection attempt
+//
+// Note: "ipAddress" is private; this field is redacted unless unsafe
+// diagnostics mode is enabled. See SetNoticeRedactionMode.
 func NoticeConnectingServer(ipAddress, region, protocol, frontingAddress string) {
-	outputNotice("ConnectingServer", false, "ipAddress", ipAddress, "region",
+	outputNotice("ConnectingServer", NoticeLevelInfo, false, "ipAddress", noticePrivate(ipAddress), "region",
 		region, "protocol", protocol, "frontingAddress", frontingAddress)
 }
 
 // NoticeActiveTunnel is a successful connection that is used as an active tunnel for port forwarding
+//
+// Note: "ipAddress" is private; this field is redacted unless unsafe
+// diagnostics mode is enabled. See SetNoticeRedactionMode.
 func NoticeActiveTunnel(ipAddress string) {
-	outputNotice("ActiveTunnel", false, "ipAddress", ipAddress)
+	outputNotice("ActiveTunnel", NoticeLevelInfo, false, "ipAddress", noticePrivate(ipAddress))
 }
 
 // NoticeSocksProxyPortInUse is a failure to use the configured LocalSocksProxyPort
 func NoticeSocksProxyPortInUse(port int) {
-	outputNotice("SocksProxyPortInUse", true, "port", port)
+	outputTypedNotice(NoticeLevelWarning, true, notice.NewPortPayload("SocksProxyPortInUse", port))
 }
 
 // NoticeListeningSocksProxyPort is the selected port for the listening local SOCKS proxy
 func NoticeListeningSocksProxyPort(port int) {
-	outputNotice("ListeningSocksProxyPort", false, "port", port)
+	outputTypedNotice(NoticeLevelInfo, false, notice.NewPortPayload("ListeningSocksProxyPort", port))
 }
 
 // NoticeSocksProxyPortInUse is a failure to use the configured LocalHttpProxyPort
 func NoticeHttpProxyPortInUse(port int) {
-	outputNotice("HttpProxyPortInUse", true, "port", port)
+	outputTypedNotice(NoticeLevelWarning, true, notice.NewPortPayload("HttpProxyPortInUse", port))
 }
 
 // NoticeListeningSocksProxyPort is the selected port for the listening local HTTP proxy
 func NoticeListeningHttpProxyPort(port int) {
-	outputNotice("ListeningHttpProxyPort", false, "port", port)
+	outputTypedNotice(NoticeLevelInfo, false, notice.NewPortPayload("ListeningHttpProxyPort", port))
 }
 
 // NoticeClientUpgradeAvailable is an available client upgrade, as per the handshake. The
 // client should download and install an upgrade.
 func NoticeClientUpgradeAvailable(version string) {
-	outputNotice("ClientUpgradeAvailable", false, "version", version)
+	outputTypedNotice(NoticeLevelInfo, false, notice.ClientUpgradeAvailablePayload{Version: version})
 }
 
 // NoticeClientUpgradeAvailable is a sponsor homepage, as per the handshake. The client
 // should display the sponsor's homepage.
+//
+// Note: "url" is private; this field is redacted unless unsafe diagnostics
+// mode is enabled. See SetNoticeRedactionMode.
 func NoticeHomepage(url string) {
-	outputNotice("Homepage", false, "url", url)
+	outputNotice("Homepage", NoticeLevelInfo, false, "url", noticePrivate(url))
 }
 
 // NoticeTunnels is how many active tunnels are available. The client should use this to
 // determine connecting/unexpected disconnect state transitions. When count is 0, the core is
 // disconnected; when count > 1, the core is connected.
 func NoticeTunnels(count int) {
-	outputNotice("Tunnels", false, "count", count)
+	outputTypedNotice(NoticeLevelInfo, false, notice.TunnelsPayload{Count: count})
 }
 
 // NoticeUntunneled indicates than an address has been classified as untunneled and is being
 // accessed directly.
 //
-// Note: "address" should remain private; this notice should only be used for alerting
-// users, not for diagnostics logs.
+// Note: "address" is private; this field is redacted unless unsafe
+// diagnostics mode is enabled. See SetNoticeRedactionMode.
 //
 func NoticeUntunneled(address string) {
-	outputNotice("Untunneled", true, "address", address)
+	outputNotice("Untunneled", NoticeLevelInfo, true, "address", noticePrivate(address))
 }
 
 // NoticeSplitTunnelRegion reports that split tunnel is on for the given region.
 func NoticeSplitTunnelRegion(region string) {
-	outputNotice("SplitTunnelRegion", true, "region", region)
+	outputTypedNotice(NoticeLevelInfo, true, notice.SplitTunnelRegionPayload{Region: region})
 }
 
 type noticeObject struct {
 	NoticeType string          `json:"noticeType"`
 	Data       json.RawMessage `json:"data"`
 	Timestamp  string          `json:"timestamp"`
+	Level      string          `json:"level"`
 }
 
 // GetNoticeTunnels receives a JSON encoded object and attempts to parse it as a Notice.
 // When the object is a Notice of type Tunnels, the count payload is returned.
-func GetNoticeTunnels(notice []byte) (count int, ok bool) {
-	var object noticeObject
-	if json.Unmarshal(notice, &object) != nil {
+func GetNoticeTunnels(encodedNotice []byte) (count int, ok bool) {
+	payload, noticeType, ok := getNoticePayload(encodedNotice)
+	if !ok || noticeType != "Tunnels" {
 		return 0, false
 	}
-	if object.NoticeType != "Tunnels" {
+	tunnels, ok := payload.(*notice.TunnelsPayload)
+	if !ok {
 		return 0, false
 	}
-	type tunnelsPayload struct {
-		Count int `json:"count"`
+	return tunnels.Count, true
+}
+
+// getNoticePayload parses an encoded notice and dispatches its "data"
+// field into the concrete notice.Payload type registered for its
+// noticeType, via notice.Unmarshal. GetNotice* helpers are thin wrappers
+// around this.
+func getNoticePayload(encodedNotice []byte) (payload notice.Payload, noticeType string, ok bool) {
+	var object noticeObject
+	if json.Unmarshal(encodedNotice, &object) != nil {
+		return nil, "", false
 	}
-	var payload tunnelsPayload
-	if json.Unmarshal(object.Data, &payload) != nil {
-		return 0, false
+	payload, ok = notice.Unmarshal(object.NoticeType, object.Data)
+	if !ok {
+		return nil, "", false
 	}
-	return payload.Count, true
+	return payload, object.NoticeType, true
 }
 
 // NoticeReceiver consumes a notice input stream and invokes a callback function
 // for each discrete JSON notice object byte sequence.
 type NoticeReceiver struct {
-	mutex    sync.Mutex
-	buffer   []byte
-	callback func([]byte)
+	mutex         sync.Mutex
+	buffer        []byte
+	callback      func([]byte)
+	typedCallback func(noticeType string, payload notice.Payload)
 }
 
 // NewNoticeReceiver initializes a new NoticeReceiver
@@ -213,6 +391,18 @@ func NewNoticeReceiver(callback func([]byte)) *NoticeReceiver {
 	return &NoticeReceiver{callback: callback}
 }
 
+// NewTypedNoticeReceiver initializes a new NoticeReceiver that, in addition
+// to invoking callback with the raw notice bytes, dispatches each notice's
+// "data" field into its concrete notice.Payload type and invokes
+// typedCallback. typedCallback is skipped for notice types with no
+// registered payload (see notice.Unmarshal).
+func NewTypedNoticeReceiver(
+	callback func([]byte),
+	typedCallback func(noticeType string, payload notice.Payload)) *NoticeReceiver {
+
+	return &NoticeReceiver{callback: callback, typedCallback: typedCallback}
+}
+
 // Write implements io.Writer.
 func (receiver *NoticeReceiver) Write(p []byte) (n int, err error) {
 	receiver.mutex.Lock()
@@ -225,10 +415,16 @@ func (receiver *NoticeReceiver) Write(p []byte) (n int, err error) {
 		return len(p), nil
 	}
 
-	notice := receiver.buffer[:index]
+	encodedNotice := receiver.buffer[:index]
 	receiver.buffer = receiver.buffer[index+1:]
 
-	receiver.callback(notice)
+	receiver.callback(encodedNotice)
+
+	if receiver.typedCallback != nil {
+		if payload, noticeType, ok := getNoticePayload(encodedNotice); ok {
+			receiver.typedCallback(noticeType, payload)
+		}
+	}
 
 	return len(p), nil
 }
@@ -242,8 +438,9 @@ func NewNoticeConsoleRewriter(writer io.Writer) *NoticeReceiver {
 		_ = json.Unmarshal(notice, &object)
 		fmt.Fprintf(
 			writer,
-			"%s %s %s\n",
+			"%s %s %s %s\n",
 			object.Timestamp,
+			object.Level,
 			object.NoticeType,
 			string(object.Data))
 	})
@@ -0,0 +1,415 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package notice defines concrete, typed "data" payloads for each notice
+// type emitted by the psiphon package, along with fast, reflection-free
+// MarshalJSON implementations.
+//
+// Prior to this package, outputNotice built every notice's data payload as
+// a map[string]interface{} and relied on encoding/json's reflection-based
+// encoder. On the hottest paths -- SOCKS connection logging, tunnel
+// bring-up -- that allocated a map and a set of interface{} boxes per
+// notice. The types here are marshaled field-by-field into a
+// pre-sized buffer, avoiding both.
+//
+// Decoding is comparatively rare (diagnostics tooling, GetNotice* helpers)
+// so UnmarshalJSON is implemented in terms of a private mirror struct and
+// the standard encoding/json decoder, rather than a hand-rolled parser.
+package notice
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// Payload is implemented by every typed notice data payload. NoticeType
+// returns the "noticeType" value the payload is associated with.
+type Payload interface {
+	json.Marshaler
+	NoticeType() string
+}
+
+// appendJSONString appends the JSON-quoted form of s to buf.
+func appendJSONString(buf []byte, s string) []byte {
+	quoted, _ := json.Marshal(s)
+	return append(buf, quoted...)
+}
+
+// CoreVersionPayload is the data payload of a "CoreVersion" notice.
+type CoreVersionPayload struct {
+	Version string
+}
+
+func (p CoreVersionPayload) NoticeType() string { return "CoreVersion" }
+
+func (p CoreVersionPayload) MarshalJSON() ([]byte, error) {
+	buf := make([]byte, 0, 32+len(p.Version))
+	buf = append(buf, `{"version":`...)
+	buf = appendJSONString(buf, p.Version)
+	buf = append(buf, '}')
+	return buf, nil
+}
+
+func (p *CoreVersionPayload) UnmarshalJSON(data []byte) error {
+	var mirror struct {
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal(data, &mirror); err != nil {
+		return err
+	}
+	p.Version = mirror.Version
+	return nil
+}
+
+// CandidateServersPayload is the data payload of a "CandidateServers" notice.
+type CandidateServersPayload struct {
+	Region   string
+	Protocol string
+	Count    int
+}
+
+func (p CandidateServersPayload) NoticeType() string { return "CandidateServers" }
+
+func (p CandidateServersPayload) MarshalJSON() ([]byte, error) {
+	buf := make([]byte, 0, 64+len(p.Region)+len(p.Protocol))
+	buf = append(buf, `{"region":`...)
+	buf = appendJSONString(buf, p.Region)
+	buf = append(buf, `,"protocol":`...)
+	buf = appendJSONString(buf, p.Protocol)
+	buf = append(buf, `,"count":`...)
+	buf = strconv.AppendInt(buf, int64(p.Count), 10)
+	buf = append(buf, '}')
+	return buf, nil
+}
+
+func (p *CandidateServersPayload) UnmarshalJSON(data []byte) error {
+	var mirror struct {
+		Region   string `json:"region"`
+		Protocol string `json:"protocol"`
+		Count    int    `json:"count"`
+	}
+	if err := json.Unmarshal(data, &mirror); err != nil {
+		return err
+	}
+	p.Region, p.Protocol, p.Count = mirror.Region, mirror.Protocol, mirror.Count
+	return nil
+}
+
+// ConnectingServerPayload is the data payload of a "ConnectingServer" notice.
+type ConnectingServerPayload struct {
+	IPAddress       string
+	Region          string
+	Protocol        string
+	FrontingAddress string
+}
+
+func (p ConnectingServerPayload) NoticeType() string { return "ConnectingServer" }
+
+func (p ConnectingServerPayload) MarshalJSON() ([]byte, error) {
+	buf := make([]byte, 0, 96+len(p.IPAddress)+len(p.Region)+len(p.Protocol)+len(p.FrontingAddress))
+	buf = append(buf, `{"ipAddress":`...)
+	buf = appendJSONString(buf, p.IPAddress)
+	buf = append(buf, `,"region":`...)
+	buf = appendJSONString(buf, p.Region)
+	buf = append(buf, `,"protocol":`...)
+	buf = appendJSONString(buf, p.Protocol)
+	buf = append(buf, `,"frontingAddress":`...)
+	buf = appendJSONString(buf, p.FrontingAddress)
+	buf = append(buf, '}')
+	return buf, nil
+}
+
+func (p *ConnectingServerPayload) UnmarshalJSON(data []byte) error {
+	var mirror struct {
+		IPAddress       string `json:"ipAddress"`
+		Region          string `json:"region"`
+		Protocol        string `json:"protocol"`
+		FrontingAddress string `json:"frontingAddress"`
+	}
+	if err := json.Unmarshal(data, &mirror); err != nil {
+		return err
+	}
+	p.IPAddress, p.Region, p.Protocol, p.FrontingAddress =
+		mirror.IPAddress, mirror.Region, mirror.Protocol, mirror.FrontingAddress
+	return nil
+}
+
+// ActiveTunnelPayload is the data payload of an "ActiveTunnel" notice.
+type ActiveTunnelPayload struct {
+	IPAddress string
+}
+
+func (p ActiveTunnelPayload) NoticeType() string { return "ActiveTunnel" }
+
+func (p ActiveTunnelPayload) MarshalJSON() ([]byte, error) {
+	buf := make([]byte, 0, 32+len(p.IPAddress))
+	buf = append(buf, `{"ipAddress":`...)
+	buf = appendJSONString(buf, p.IPAddress)
+	buf = append(buf, '}')
+	return buf, nil
+}
+
+func (p *ActiveTunnelPayload) UnmarshalJSON(data []byte) error {
+	var mirror struct {
+		IPAddress string `json:"ipAddress"`
+	}
+	if err := json.Unmarshal(data, &mirror); err != nil {
+		return err
+	}
+	p.IPAddress = mirror.IPAddress
+	return nil
+}
+
+// TunnelsPayload is the data payload of a "Tunnels" notice.
+type TunnelsPayload struct {
+	Count int
+}
+
+func (p TunnelsPayload) NoticeType() string { return "Tunnels" }
+
+func (p TunnelsPayload) MarshalJSON() ([]byte, error) {
+	buf := make([]byte, 0, 20)
+	buf = append(buf, `{"count":`...)
+	buf = strconv.AppendInt(buf, int64(p.Count), 10)
+	buf = append(buf, '}')
+	return buf, nil
+}
+
+func (p *TunnelsPayload) UnmarshalJSON(data []byte) error {
+	var mirror struct {
+		Count int `json:"count"`
+	}
+	if err := json.Unmarshal(data, &mirror); err != nil {
+		return err
+	}
+	p.Count = mirror.Count
+	return nil
+}
+
+// PortPayload is the data payload shared by the "SocksProxyPortInUse",
+// "ListeningSocksProxyPort", "HttpProxyPortInUse", and
+// "ListeningHttpProxyPort" notices, which all carry a single port number.
+type PortPayload struct {
+	noticeType string
+	Port       int
+}
+
+func NewPortPayload(noticeType string, port int) PortPayload {
+	return PortPayload{noticeType: noticeType, Port: port}
+}
+
+func (p PortPayload) NoticeType() string { return p.noticeType }
+
+func (p PortPayload) MarshalJSON() ([]byte, error) {
+	buf := make([]byte, 0, 20)
+	buf = append(buf, `{"port":`...)
+	buf = strconv.AppendInt(buf, int64(p.Port), 10)
+	buf = append(buf, '}')
+	return buf, nil
+}
+
+func (p *PortPayload) UnmarshalJSON(data []byte) error {
+	var mirror struct {
+		Port int `json:"port"`
+	}
+	if err := json.Unmarshal(data, &mirror); err != nil {
+		return err
+	}
+	p.Port = mirror.Port
+	return nil
+}
+
+// ClientUpgradeAvailablePayload is the data payload of a
+// "ClientUpgradeAvailable" notice.
+type ClientUpgradeAvailablePayload struct {
+	Version string
+}
+
+func (p ClientUpgradeAvailablePayload) NoticeType() string { return "ClientUpgradeAvailable" }
+
+func (p ClientUpgradeAvailablePayload) MarshalJSON() ([]byte, error) {
+	buf := make([]byte, 0, 32+len(p.Version))
+	buf = append(buf, `{"version":`...)
+	buf = appendJSONString(buf, p.Version)
+	buf = append(buf, '}')
+	return buf, nil
+}
+
+func (p *ClientUpgradeAvailablePayload) UnmarshalJSON(data []byte) error {
+	var mirror struct {
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal(data, &mirror); err != nil {
+		return err
+	}
+	p.Version = mirror.Version
+	return nil
+}
+
+// HomepagePayload is the data payload of a "Homepage" notice.
+type HomepagePayload struct {
+	URL string
+}
+
+func (p HomepagePayload) NoticeType() string { return "Homepage" }
+
+func (p HomepagePayload) MarshalJSON() ([]byte, error) {
+	buf := make([]byte, 0, 32+len(p.URL))
+	buf = append(buf, `{"url":`...)
+	buf = appendJSONString(buf, p.URL)
+	buf = append(buf, '}')
+	return buf, nil
+}
+
+func (p *HomepagePayload) UnmarshalJSON(data []byte) error {
+	var mirror struct {
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal(data, &mirror); err != nil {
+		return err
+	}
+	p.URL = mirror.URL
+	return nil
+}
+
+// UntunneledPayload is the data payload of an "Untunneled" notice.
+type UntunneledPayload struct {
+	Address string
+}
+
+func (p UntunneledPayload) NoticeType() string { return "Untunneled" }
+
+func (p UntunneledPayload) MarshalJSON() ([]byte, error) {
+	buf := make([]byte, 0, 32+len(p.Address))
+	buf = append(buf, `{"address":`...)
+	buf = appendJSONString(buf, p.Address)
+	buf = append(buf, '}')
+	return buf, nil
+}
+
+func (p *UntunneledPayload) UnmarshalJSON(data []byte) error {
+	var mirror struct {
+		Address string `json:"address"`
+	}
+	if err := json.Unmarshal(data, &mirror); err != nil {
+		return err
+	}
+	p.Address = mirror.Address
+	return nil
+}
+
+// SplitTunnelRegionPayload is the data payload of a "SplitTunnelRegion" notice.
+type SplitTunnelRegionPayload struct {
+	Region string
+}
+
+func (p SplitTunnelRegionPayload) NoticeType() string { return "SplitTunnelRegion" }
+
+func (p SplitTunnelRegionPayload) MarshalJSON() ([]byte, error) {
+	buf := make([]byte, 0, 32+len(p.Region))
+	buf = append(buf, `{"region":`...)
+	buf = appendJSONString(buf, p.Region)
+	buf = append(buf, '}')
+	return buf, nil
+}
+
+func (p *SplitTunnelRegionPayload) UnmarshalJSON(data []byte) error {
+	var mirror struct {
+		Region string `json:"region"`
+	}
+	if err := json.Unmarshal(data, &mirror); err != nil {
+		return err
+	}
+	p.Region = mirror.Region
+	return nil
+}
+
+// MessagePayload is the data payload shared by the "Debug", "Info",
+// "Alert", "Error", and "Log" notices, which all carry a single formatted
+// message string.
+type MessagePayload struct {
+	noticeType string
+	Message    string
+}
+
+func NewMessagePayload(noticeType string, message string) MessagePayload {
+	return MessagePayload{noticeType: noticeType, Message: message}
+}
+
+func (p MessagePayload) NoticeType() string { return p.noticeType }
+
+func (p MessagePayload) MarshalJSON() ([]byte, error) {
+	buf := make([]byte, 0, 32+len(p.Message))
+	buf = append(buf, `{"message":`...)
+	buf = appendJSONString(buf, p.Message)
+	buf = append(buf, '}')
+	return buf, nil
+}
+
+func (p *MessagePayload) UnmarshalJSON(data []byte) error {
+	var mirror struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(data, &mirror); err != nil {
+		return err
+	}
+	p.Message = mirror.Message
+	return nil
+}
+
+// Unmarshal parses data, the "data" field of a notice JSON object, into
+// the concrete payload type registered for noticeType. It returns
+// (nil, false) for notice types with no registered payload.
+func Unmarshal(noticeType string, data []byte) (Payload, bool) {
+	var payload Payload
+	switch noticeType {
+	case "CoreVersion":
+		payload = &CoreVersionPayload{}
+	case "CandidateServers":
+		payload = &CandidateServersPayload{}
+	case "ConnectingServer":
+		payload = &ConnectingServerPayload{}
+	case "ActiveTunnel":
+		payload = &ActiveTunnelPayload{}
+	case "Tunnels":
+		payload = &TunnelsPayload{}
+	case "SocksProxyPortInUse", "ListeningSocksProxyPort", "HttpProxyPortInUse", "ListeningHttpProxyPort":
+		port := &PortPayload{}
+		port.noticeType = noticeType
+		payload = port
+	case "ClientUpgradeAvailable":
+		payload = &ClientUpgradeAvailablePayload{}
+	case "Homepage":
+		payload = &HomepagePayload{}
+	case "Untunneled":
+		payload = &UntunneledPayload{}
+	case "SplitTunnelRegion":
+		payload = &SplitTunnelRegionPayload{}
+	case "Debug", "Info", "Alert", "Error", "Log":
+		message := &MessagePayload{}
+		message.noticeType = noticeType
+		payload = message
+	default:
+		return nil, false
+	}
+	if err := json.Unmarshal(data, payload); err != nil {
+		return nil, false
+	}
+	return payload, true
+}
@@ -0,0 +1,56 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"io"
+	"testing"
+)
+
+// BenchmarkNoticeTunnels exercises the typed, reflection-free
+// outputTypedNotice path.
+func BenchmarkNoticeTunnels(b *testing.B) {
+	SetNoticeOutput(io.Discard)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		NoticeTunnels(i)
+	}
+}
+
+// BenchmarkNoticeInfo exercises the typed, reflection-free
+// outputTypedNotice path for the high-frequency message notices.
+func BenchmarkNoticeInfo(b *testing.B) {
+	SetNoticeOutput(io.Discard)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		NoticeInfo("benchmark message %d", i)
+	}
+}
+
+// BenchmarkNoticeConnectingServer exercises the map[string]interface{} path,
+// still used where per-field redaction is required (see
+// SetNoticeRedactionMode), for comparison against the typed path above.
+func BenchmarkNoticeConnectingServer(b *testing.B) {
+	SetNoticeOutput(io.Discard)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		NoticeConnectingServer("203.0.113.1", "US", "OSSH", "")
+	}
+}
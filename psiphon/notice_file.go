@@ -0,0 +1,457 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RotateOptions configures the rotation behavior of a NewRotatingNoticeFile.
+type RotateOptions struct {
+
+	// MaxSize is the file size, in bytes, at which the file is rotated.
+	// When <= 0, size-based rotation is disabled.
+	MaxSize int64
+
+	// MaxBackups is the number of rotated backup files retained; older
+	// backups beyond this count are deleted. When <= 0, no count-based
+	// pruning is performed.
+	MaxBackups int
+
+	// MaxAge is the maximum age of a rotated backup file before it is
+	// deleted. When <= 0, no age-based pruning is performed.
+	MaxAge time.Duration
+
+	// Compress gzips a backup file once rotated out of the active file.
+	Compress bool
+
+	// Sync causes the file to be fsync'd after every Write.
+	Sync bool
+}
+
+// rotatingNoticeFileBackupQueueSize bounds the number of rotated backups
+// awaiting compression and pruning. It is sized generously relative to
+// RotateOptions.MaxSize-triggered rotation frequency; if it does fill,
+// rotateLocked leaves the backup uncompressed rather than block the
+// writer, and a later, successful queue drain will still prune it
+// normally.
+const rotatingNoticeFileBackupQueueSize = 64
+
+// rotatingNoticeFile is an io.Writer over a notice output file that
+// rotates to a timestamped backup when it grows past RotateOptions.MaxSize,
+// pruning old backups per RotateOptions.MaxBackups/MaxAge.
+//
+// Its mutex is independent of noticeLoggerMutex: SetNoticeOutput only
+// requires that whatever writer it's given has its own internal
+// synchronization, as noticeLogger.Print is already serialized by
+// noticeLoggerMutex.
+//
+// Compression and pruning of a rotated backup both run on a single
+// runBackupWorker goroutine, draining pendingBackups in the order backups
+// are rotated. Rotation can outpace the worker, so pendingSet also tracks
+// every backup that has been rotated but not yet compressed; pruneBackups
+// consults it to never delete a backup that is still awaiting its turn on
+// the worker, even though that backup is already sitting on disk as a
+// plain, uncompressed file.
+type rotatingNoticeFile struct {
+	mutex          sync.Mutex
+	path           string
+	opts           RotateOptions
+	file           *os.File
+	size           int64
+	stopChan       chan struct{}
+	stopOnce       sync.Once
+	pendingBackups chan string
+	pendingMutex   sync.Mutex
+	pendingSet     map[string]bool
+}
+
+var rotatingNoticeFileMutex sync.Mutex
+var activeRotatingNoticeFile *rotatingNoticeFile
+
+// NewRotatingNoticeFile creates an io.Writer, suitable for SetNoticeOutput,
+// which writes notices to the file at path and rotates per opts. Rotation
+// is non-blocking from the writer's perspective: the active file is
+// closed and atomically renamed to a timestamped backup, a new file is
+// opened in its place, and any gzip compression or backup pruning runs on
+// a dedicated background worker (see runBackupWorker).
+//
+// The most recently created rotating notice file is also used by
+// NoticeDiagnosticsBundle. Calling NewRotatingNoticeFile again, e.g. to
+// reconfigure rotation settings at runtime, stops the SIGHUP watcher and
+// backup worker goroutines of any previously created instance, mirroring the HTTP sink's
+// replace-and-stop lifecycle (see SetNoticeHTTPSink).
+func NewRotatingNoticeFile(path string, opts RotateOptions) io.Writer {
+	r := &rotatingNoticeFile{
+		path:           path,
+		opts:           opts,
+		stopChan:       make(chan struct{}),
+		pendingBackups: make(chan string, rotatingNoticeFileBackupQueueSize),
+	}
+
+	r.mutex.Lock()
+	if err := r.openLocked(); err != nil {
+		NoticeAlert("failed to open notice file %s: %s", path, err)
+	}
+	r.mutex.Unlock()
+
+	go r.watchSIGHUP()
+	go r.runBackupWorker()
+
+	rotatingNoticeFileMutex.Lock()
+	previousFile := activeRotatingNoticeFile
+	activeRotatingNoticeFile = r
+	rotatingNoticeFileMutex.Unlock()
+
+	if previousFile != nil {
+		previousFile.stop()
+	}
+
+	return r
+}
+
+// stop terminates the SIGHUP watcher and backup worker goroutines. It is
+// called when this instance is replaced as the active rotating notice
+// file, so reconfiguring rotation settings at runtime doesn't leak
+// goroutines per call.
+func (r *rotatingNoticeFile) stop() {
+	r.stopOnce.Do(func() {
+		close(r.stopChan)
+	})
+}
+
+// openLocked opens, or reopens, the active notice file. The caller must
+// hold r.mutex.
+func (r *rotatingNoticeFile) openLocked() error {
+	file, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return ContextError(err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return ContextError(err)
+	}
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+// Write implements io.Writer.
+func (r *rotatingNoticeFile) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.file == nil {
+		if err := r.openLocked(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	if err != nil {
+		return n, err
+	}
+
+	if r.opts.Sync {
+		_ = r.file.Sync()
+	}
+
+	if r.opts.MaxSize > 0 && r.size >= r.opts.MaxSize {
+		r.rotateLocked()
+	}
+
+	return n, nil
+}
+
+// rotateLocked closes the active file, atomically renames it to a
+// timestamped backup, and opens a new active file. The caller must hold
+// r.mutex. Compression and pruning of old backups are handed off to
+// runBackupWorker so rotation itself doesn't block the writer.
+func (r *rotatingNoticeFile) rotateLocked() {
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+
+	// Alerts are emitted on their own goroutine: when this file is the
+	// notice output, Write runs under noticeLoggerMutex, which NoticeAlert
+	// also takes.
+
+	backupPath := fmt.Sprintf("%s.%s", r.path, time.Now().UTC().Format("20060102T150405.000000000Z"))
+	if err := os.Rename(r.path, backupPath); err != nil {
+		go NoticeAlert("failed to rotate notice file %s: %s", r.path, err)
+		backupPath = ""
+	}
+
+	if err := r.openLocked(); err != nil {
+		go NoticeAlert("failed to reopen notice file %s: %s", r.path, err)
+	}
+
+	if backupPath != "" {
+		// Registered in pendingSet before it is queued, so the worker
+		// can't dequeue and finish it before it is registered.
+		r.pendingMutex.Lock()
+		if r.pendingSet == nil {
+			r.pendingSet = make(map[string]bool)
+		}
+		r.pendingSet[backupPath] = true
+		r.pendingMutex.Unlock()
+
+		select {
+		case r.pendingBackups <- backupPath:
+		default:
+			r.pendingMutex.Lock()
+			delete(r.pendingSet, backupPath)
+			r.pendingMutex.Unlock()
+			// The worker is backed up; leave this backup uncompressed
+			// rather than spawn a concurrent compressor that could race
+			// the worker's next pruneBackups call.
+			go NoticeAlert("notice file backup queue is full, leaving %s uncompressed", backupPath)
+		}
+	}
+}
+
+// runBackupWorker drains pendingBackups, compressing (if configured) and
+// then pruning backups one at a time, in rotation order.
+func (r *rotatingNoticeFile) runBackupWorker() {
+	for {
+		select {
+		case backupPath := <-r.pendingBackups:
+			if r.opts.Compress {
+				if _, err := gzipFile(backupPath); err != nil {
+					NoticeAlert("failed to compress notice file backup %s: %s", backupPath, err)
+				}
+			}
+
+			r.pendingMutex.Lock()
+			delete(r.pendingSet, backupPath)
+			r.pendingMutex.Unlock()
+
+			r.pruneBackups()
+		case <-r.stopChan:
+			return
+		}
+	}
+}
+
+// pruneBackups deletes backups older than RotateOptions.MaxAge and, beyond
+// RotateOptions.MaxBackups, the oldest excess backups. Backups still
+// awaiting compression on runBackupWorker -- rotated, but not yet handed
+// off the pendingBackups queue -- are left untouched, so a rotation that
+// outpaces the worker can never have one of its still-uncompressed
+// backups pruned out from under it.
+func (r *rotatingNoticeFile) pruneBackups() {
+	matches, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return
+	}
+
+	r.pendingMutex.Lock()
+	pending := make(map[string]bool, len(r.pendingSet))
+	for backupPath := range r.pendingSet {
+		pending[backupPath] = true
+	}
+	r.pendingMutex.Unlock()
+
+	candidates := make([]string, 0, len(matches))
+	for _, backupPath := range matches {
+		if !pending[backupPath] {
+			candidates = append(candidates, backupPath)
+		}
+	}
+	sort.Strings(candidates)
+
+	var kept []string
+	now := time.Now()
+	for _, backupPath := range candidates {
+		if r.opts.MaxAge > 0 {
+			info, err := os.Stat(backupPath)
+			if err == nil && now.Sub(info.ModTime()) > r.opts.MaxAge {
+				os.Remove(backupPath)
+				continue
+			}
+		}
+		kept = append(kept, backupPath)
+	}
+
+	if r.opts.MaxBackups > 0 && len(kept) > r.opts.MaxBackups {
+		for _, backupPath := range kept[:len(kept)-r.opts.MaxBackups] {
+			os.Remove(backupPath)
+		}
+	}
+}
+
+// Reopen closes and reopens the active file at the same path, without
+// rotating. This is used to pick up an external log rotation -- e.g. a
+// SIGHUP handler after logrotate has moved the file aside.
+func (r *rotatingNoticeFile) Reopen() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+	if err := r.openLocked(); err != nil {
+		NoticeAlert("failed to reopen notice file %s: %s", r.path, err)
+	}
+}
+
+// diagnosticsFiles returns the active file and all backup files, oldest
+// first, for inclusion in a NoticeDiagnosticsBundle.
+func (r *rotatingNoticeFile) diagnosticsFiles() []string {
+	matches, _ := filepath.Glob(r.path + ".*")
+	sort.Strings(matches)
+	return append(matches, r.path)
+}
+
+// gzipFile compresses path in place, replacing it with path+".gz", and
+// returns the new path.
+func gzipFile(path string) (string, error) {
+	source, err := os.Open(path)
+	if err != nil {
+		return "", ContextError(err)
+	}
+	defer source.Close()
+
+	compressedPath := path + ".gz"
+	destination, err := os.OpenFile(compressedPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", ContextError(err)
+	}
+
+	gzipWriter := gzip.NewWriter(destination)
+	_, copyErr := io.Copy(gzipWriter, source)
+	closeErr := gzipWriter.Close()
+	destination.Close()
+
+	if copyErr != nil {
+		os.Remove(compressedPath)
+		return "", ContextError(copyErr)
+	}
+	if closeErr != nil {
+		os.Remove(compressedPath)
+		return "", ContextError(closeErr)
+	}
+
+	os.Remove(path)
+	return compressedPath, nil
+}
+
+// noticeDiagnosticsCacheTypes lists the notice types whose most recent
+// occurrence is retained for inclusion in a NoticeDiagnosticsBundle.
+var noticeDiagnosticsCacheTypes = map[string]bool{
+	"CoreVersion":            true,
+	"CandidateServers":       true,
+	"Tunnels":                true,
+	"ClientUpgradeAvailable": true,
+}
+
+var noticeDiagnosticsCacheMutex sync.Mutex
+var noticeDiagnosticsCache = make(map[string]string)
+
+// cacheNoticeForDiagnostics retains the most recent encoded notice of
+// noticeType, for the types in noticeDiagnosticsCacheTypes, for inclusion
+// in a NoticeDiagnosticsBundle.
+func cacheNoticeForDiagnostics(noticeType string, encodedNotice string) {
+	if !noticeDiagnosticsCacheTypes[noticeType] {
+		return
+	}
+	noticeDiagnosticsCacheMutex.Lock()
+	noticeDiagnosticsCache[noticeType] = encodedNotice
+	noticeDiagnosticsCacheMutex.Unlock()
+}
+
+// NoticeDiagnosticsBundle writes a zip archive to w containing the current
+// and rotated files of the most recently created NewRotatingNoticeFile,
+// along with the most recent CoreVersion, CandidateServers, Tunnels, and
+// ClientUpgradeAvailable notices. This is intended for user-initiated
+// feedback uploads.
+func NoticeDiagnosticsBundle(w io.Writer) error {
+	zipWriter := zip.NewWriter(w)
+
+	rotatingNoticeFileMutex.Lock()
+	sink := activeRotatingNoticeFile
+	rotatingNoticeFileMutex.Unlock()
+
+	if sink != nil {
+		for _, path := range sink.diagnosticsFiles() {
+			if err := addFileToZip(zipWriter, path); err != nil {
+				NoticeAlert("notice diagnostics bundle: failed to add %s: %s", path, err)
+			}
+		}
+	}
+
+	noticeDiagnosticsCacheMutex.Lock()
+	cached := make([]string, 0, len(noticeDiagnosticsCache))
+	for _, encodedNotice := range noticeDiagnosticsCache {
+		cached = append(cached, encodedNotice)
+	}
+	noticeDiagnosticsCacheMutex.Unlock()
+
+	if len(cached) > 0 {
+		entryWriter, err := zipWriter.Create("summary.json")
+		if err != nil {
+			return ContextError(err)
+		}
+		for _, encodedNotice := range cached {
+			if _, err := io.WriteString(entryWriter, encodedNotice); err != nil {
+				return ContextError(err)
+			}
+			if _, err := io.WriteString(entryWriter, "\n"); err != nil {
+				return ContextError(err)
+			}
+		}
+	}
+
+	if err := zipWriter.Close(); err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
+
+// addFileToZip adds the file at path to zipWriter as an entry named with
+// its base name.
+func addFileToZip(zipWriter *zip.Writer, path string) error {
+	source, err := os.Open(path)
+	if err != nil {
+		return ContextError(err)
+	}
+	defer source.Close()
+
+	entryWriter, err := zipWriter.Create(filepath.Base(path))
+	if err != nil {
+		return ContextError(err)
+	}
+
+	if _, err := io.Copy(entryWriter, source); err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRotatingNoticeFileSizeRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notice.log")
+
+	writer := NewRotatingNoticeFile(path, RotateOptions{MaxSize: 10})
+	r, ok := writer.(*rotatingNoticeFile)
+	if !ok {
+		t.Fatalf("expected *rotatingNoticeFile, got %T", writer)
+	}
+	defer r.stop()
+
+	for i := 0; i < 5; i++ {
+		if _, err := r.Write([]byte("0123456789")); err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+	}
+
+	backups, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatalf("Glob failed: %s", err)
+	}
+	if len(backups) == 0 {
+		t.Fatalf("expected at least one rotated backup file, got none")
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected active notice file to exist after rotation: %s", err)
+	}
+}
+
+// TestRotatingNoticeFileConcurrentRotation verifies that concurrent
+// Writes which repeatedly trigger size-based rotation never lose a
+// backup to a race between pruneBackups and a still-in-flight
+// compression: every surviving backup is either fully compressed or, if
+// the backup queue overflowed, left as a valid, uncompressed plain file
+// -- never partially written or missing outright -- and no "failed to
+// compress" Alert notices are produced.
+func TestRotatingNoticeFileConcurrentRotation(t *testing.T) {
+	defer SetNoticeOutput(io.Discard)
+
+	var buf bytes.Buffer
+	SetNoticeOutput(&buf)
+
+	path := filepath.Join(t.TempDir(), "notice.log")
+	writer := NewRotatingNoticeFile(path, RotateOptions{MaxSize: 50, MaxBackups: 3, Compress: true})
+	r, ok := writer.(*rotatingNoticeFile)
+	if !ok {
+		t.Fatalf("expected *rotatingNoticeFile, got %T", writer)
+	}
+	defer r.stop()
+
+	const numGoroutines = 20
+	const writesPerGoroutine = 5
+
+	var wg sync.WaitGroup
+	for i := 0; i < numGoroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < writesPerGoroutine; j++ {
+				if _, err := r.Write([]byte("0123456789")); err != nil {
+					t.Errorf("Write failed: %s", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Wait for the backup worker to drain its queue, so the result below
+	// reflects the fully settled state rather than a snapshot mid-prune.
+	for len(r.pendingBackups) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if lines := noticeLines(&buf); len(lines) > 0 {
+		t.Fatalf("expected no Alert notices from rotation, got %d: %v", len(lines), lines)
+	}
+
+	backups, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatalf("Glob failed: %s", err)
+	}
+	if len(backups) == 0 {
+		t.Fatalf("expected at least one rotated backup file, got none")
+	}
+	if len(backups) > 3 {
+		t.Errorf("expected pruning to retain at most 3 backups, got %d: %v", len(backups), backups)
+	}
+
+	for _, backupPath := range backups {
+		info, err := os.Stat(backupPath)
+		if err != nil {
+			t.Errorf("backup %s vanished: %s", backupPath, err)
+			continue
+		}
+		if info.Size() == 0 {
+			t.Errorf("backup %s is empty", backupPath)
+		}
+		if filepath.Ext(backupPath) == ".gz" {
+			gzipFile, err := os.Open(backupPath)
+			if err != nil {
+				t.Errorf("failed to open %s: %s", backupPath, err)
+				continue
+			}
+			gzipReader, err := gzip.NewReader(gzipFile)
+			if err != nil {
+				t.Errorf("backup %s is not valid gzip: %s", backupPath, err)
+			} else {
+				gzipReader.Close()
+			}
+			gzipFile.Close()
+		}
+	}
+}
+
+func TestRotatingNoticeFilePruneByBackupCount(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "notice.log")
+
+	names := []string{
+		path + ".20200101T000000.000000000Z",
+		path + ".20200102T000000.000000000Z",
+		path + ".20200103T000000.000000000Z",
+		path + ".20200104T000000.000000000Z",
+	}
+	for _, name := range names {
+		if err := os.WriteFile(name, []byte("x"), 0600); err != nil {
+			t.Fatalf("WriteFile failed: %s", err)
+		}
+	}
+
+	r := &rotatingNoticeFile{path: path, opts: RotateOptions{MaxBackups: 2}}
+	r.pruneBackups()
+
+	remaining, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatalf("Glob failed: %s", err)
+	}
+	sort.Strings(remaining)
+
+	if len(remaining) != 2 {
+		t.Fatalf("expected 2 backups to remain, got %d: %v", len(remaining), remaining)
+	}
+	if remaining[0] != names[2] || remaining[1] != names[3] {
+		t.Errorf("expected the 2 newest backups to remain, got %v", remaining)
+	}
+}
+
+func TestRotatingNoticeFilePruneByAge(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "notice.log")
+
+	oldBackup := path + ".old"
+	newBackup := path + ".new"
+	for _, name := range []string{oldBackup, newBackup} {
+		if err := os.WriteFile(name, []byte("x"), 0600); err != nil {
+			t.Fatalf("WriteFile failed: %s", err)
+		}
+	}
+
+	oldTime := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(oldBackup, oldTime, oldTime); err != nil {
+		t.Fatalf("Chtimes failed: %s", err)
+	}
+
+	r := &rotatingNoticeFile{path: path, opts: RotateOptions{MaxAge: 24 * time.Hour}}
+	r.pruneBackups()
+
+	if _, err := os.Stat(oldBackup); !os.IsNotExist(err) {
+		t.Errorf("expected the old backup to be pruned")
+	}
+	if _, err := os.Stat(newBackup); err != nil {
+		t.Errorf("expected the new backup to remain: %s", err)
+	}
+}
+
+func TestGzipFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "notice.log.backup")
+	content := []byte(`{"noticeType":"Info","data":{"message":"hello"}}`)
+
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	compressedPath, err := gzipFile(path)
+	if err != nil {
+		t.Fatalf("gzipFile failed: %s", err)
+	}
+	if compressedPath != path+".gz" {
+		t.Fatalf("expected compressed path %s, got %s", path+".gz", compressedPath)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the original backup file to be removed")
+	}
+
+	compressedFile, err := os.Open(compressedPath)
+	if err != nil {
+		t.Fatalf("failed to open compressed backup: %s", err)
+	}
+	defer compressedFile.Close()
+
+	gzipReader, err := gzip.NewReader(compressedFile)
+	if err != nil {
+		t.Fatalf("failed to open gzip reader: %s", err)
+	}
+	defer gzipReader.Close()
+
+	decompressed, err := io.ReadAll(gzipReader)
+	if err != nil {
+		t.Fatalf("failed to decompress: %s", err)
+	}
+	if string(decompressed) != string(content) {
+		t.Errorf("expected decompressed content %q, got %q", content, decompressed)
+	}
+}
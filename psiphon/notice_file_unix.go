@@ -0,0 +1,46 @@
+//go:build !windows
+
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchSIGHUP reopens the notice file whenever the process receives
+// SIGHUP, so the file can be rotated externally -- e.g. by logrotate --
+// without restarting. It exits, and unregisters its signal channel, once
+// r.stop is called.
+func (r *rotatingNoticeFile) watchSIGHUP() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case <-signals:
+			r.Reopen()
+		case <-r.stopChan:
+			return
+		}
+	}
+}
@@ -0,0 +1,293 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+const (
+	defaultNoticeHTTPSinkBatchSize     = 50
+	defaultNoticeHTTPSinkBatchInterval = 5 * time.Second
+	noticeHTTPSinkQueueSize            = 1000
+	noticeHTTPSinkMaxRetries           = 5
+	noticeHTTPSinkInitialBackoff       = 500 * time.Millisecond
+)
+
+// NoticeHTTPSinkConfig specifies the configuration for an HTTP notice
+// sink set via SetNoticeHTTPSink.
+type NoticeHTTPSinkConfig struct {
+
+	// URL is the endpoint notices are POSTed to.
+	URL string
+
+	// Headers are added to every POST request, e.g. for authentication.
+	Headers map[string]string
+
+	// IncludeTypes restricts forwarding to only the listed noticeType
+	// values. When empty, all notice types are forwarded.
+	IncludeTypes []string
+
+	// Template, when set, renders each batch -- a []string of JSON-encoded
+	// notices -- into the POST body. When nil, the batch is rendered as a
+	// raw JSON array of the encoded notices.
+	Template *template.Template
+
+	// BatchSize is the number of notices accumulated before a batch is
+	// sent. When <= 0, defaultNoticeHTTPSinkBatchSize is used.
+	BatchSize int
+
+	// BatchInterval is the maximum time a partial batch is held before
+	// being sent. When <= 0, defaultNoticeHTTPSinkBatchInterval is used.
+	BatchInterval time.Duration
+
+	// TLSConfig, when set, configures the HTTP client's transport.
+	TLSConfig *tls.Config
+}
+
+var httpSinkMutex sync.Mutex
+var activeHTTPSink *noticeHTTPSink
+
+// SetNoticeHTTPSink starts an HTTP emitter which POSTs notices to
+// config.URL, batched and templated per config. Notices are queued from
+// outputNotice/outputTypedNotice via a bounded, non-blocking channel: if
+// the queue is saturated, the oldest queued notice is dropped to make
+// room and a NoticeHTTPSinkOverflow notice reports the total drop count.
+// Delivery failures are retried with exponential backoff; this does not
+// block notice emission.
+//
+// Calling SetNoticeHTTPSink again replaces and stops any previously
+// configured sink.
+func SetNoticeHTTPSink(config NoticeHTTPSinkConfig) {
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultNoticeHTTPSinkBatchSize
+	}
+	if config.BatchInterval <= 0 {
+		config.BatchInterval = defaultNoticeHTTPSinkBatchInterval
+	}
+
+	sink := &noticeHTTPSink{
+		config:   config,
+		notices:  make(chan string, noticeHTTPSinkQueueSize),
+		stopChan: make(chan struct{}),
+		httpClient: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: config.TLSConfig},
+			Timeout:   30 * time.Second,
+		},
+	}
+	if len(config.IncludeTypes) > 0 {
+		sink.includeTypes = make(map[string]bool, len(config.IncludeTypes))
+		for _, noticeType := range config.IncludeTypes {
+			sink.includeTypes[noticeType] = true
+		}
+	}
+
+	httpSinkMutex.Lock()
+	previousSink := activeHTTPSink
+	activeHTTPSink = sink
+	httpSinkMutex.Unlock()
+
+	if previousSink != nil {
+		previousSink.stop()
+	}
+
+	go sink.run()
+}
+
+// dispatchToHTTPSink forwards an already-encoded notice to the active
+// HTTP sink, if one is configured. It is called after the notice has been
+// written to the primary notice output, and never blocks the caller.
+func dispatchToHTTPSink(noticeType string, encodedNotice string) {
+	// NoticeHTTPSinkOverflow is a diagnostic about the sink itself; it is
+	// never re-queued into the sink, which would otherwise risk a feedback
+	// loop while the sink is saturated.
+	if noticeType == "HTTPSinkOverflow" {
+		return
+	}
+
+	httpSinkMutex.Lock()
+	sink := activeHTTPSink
+	httpSinkMutex.Unlock()
+
+	if sink == nil {
+		return
+	}
+
+	sink.enqueue(noticeType, encodedNotice)
+}
+
+// noticeHTTPSink batches and POSTs notices to an HTTP endpoint.
+type noticeHTTPSink struct {
+	config        NoticeHTTPSinkConfig
+	includeTypes  map[string]bool
+	notices       chan string
+	stopChan      chan struct{}
+	stopOnce      sync.Once
+	overflowCount int64
+	httpClient    *http.Client
+}
+
+func (sink *noticeHTTPSink) stop() {
+	sink.stopOnce.Do(func() {
+		close(sink.stopChan)
+	})
+}
+
+// enqueue adds an encoded notice to the sink's queue. If the queue is
+// full, the oldest queued notice is dropped to make room.
+func (sink *noticeHTTPSink) enqueue(noticeType string, encodedNotice string) {
+	if sink.includeTypes != nil && !sink.includeTypes[noticeType] {
+		return
+	}
+
+	select {
+	case sink.notices <- encodedNotice:
+		return
+	default:
+	}
+
+	select {
+	case <-sink.notices:
+	default:
+	}
+	select {
+	case sink.notices <- encodedNotice:
+	default:
+	}
+
+	count := atomic.AddInt64(&sink.overflowCount, 1)
+	NoticeHTTPSinkOverflow(count)
+}
+
+// run batches queued notices, by count and by time, and POSTs each batch.
+func (sink *noticeHTTPSink) run() {
+	batch := make([]string, 0, sink.config.BatchSize)
+
+	ticker := time.NewTicker(sink.config.BatchInterval)
+	defer ticker.Stop()
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		sink.post(batch)
+		batch = make([]string, 0, sink.config.BatchSize)
+	}
+
+	for {
+		select {
+		case encodedNotice := <-sink.notices:
+			batch = append(batch, encodedNotice)
+			if len(batch) >= sink.config.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-sink.stopChan:
+			flush()
+			return
+		}
+	}
+}
+
+// post renders and sends a single batch, retrying transient failures with
+// exponential backoff.
+func (sink *noticeHTTPSink) post(batch []string) {
+	body, err := sink.render(batch)
+	if err != nil {
+		NoticeAlert("notice HTTP sink render failed: %s", err)
+		return
+	}
+
+	backoff := noticeHTTPSinkInitialBackoff
+	for attempt := 0; attempt < noticeHTTPSinkMaxRetries; attempt++ {
+		if sink.send(body) {
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-sink.stopChan:
+			return
+		}
+		backoff *= 2
+	}
+
+	NoticeAlert("notice HTTP sink dropped batch of %d notices after %d attempts", len(batch), noticeHTTPSinkMaxRetries)
+}
+
+// render renders a batch of JSON-encoded notices into the POST body,
+// via config.Template if set, or else as a raw JSON array.
+func (sink *noticeHTTPSink) render(batch []string) ([]byte, error) {
+	if sink.config.Template != nil {
+		var buf bytes.Buffer
+		if err := sink.config.Template.Execute(&buf, batch); err != nil {
+			return nil, ContextError(err)
+		}
+		return buf.Bytes(), nil
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for i, encodedNotice := range batch {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(encodedNotice)
+	}
+	buf.WriteByte(']')
+	return buf.Bytes(), nil
+}
+
+// send POSTs body to the sink's URL, returning true on a 2xx response.
+func (sink *noticeHTTPSink) send(body []byte) bool {
+	request, err := http.NewRequest("POST", sink.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	for name, value := range sink.config.Headers {
+		request.Header.Set(name, value)
+	}
+	if request.Header.Get("Content-Type") == "" {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	response, err := sink.httpClient.Do(request)
+	if err != nil {
+		return false
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(io.Discard, response.Body)
+
+	return response.StatusCode >= 200 && response.StatusCode < 300
+}
+
+// NoticeHTTPSinkOverflow reports that the HTTP sink's notice queue was
+// saturated and the oldest queued notice was dropped to make room. count
+// is the cumulative number of notices dropped by this sink.
+func NoticeHTTPSinkOverflow(count int64) {
+	outputNotice("HTTPSinkOverflow", NoticeLevelWarning, true, "count", count)
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestNoticeHTTPSinkOverflow verifies that enqueue drops the oldest queued
+// notice, rather than blocking, once the queue is saturated, and reports
+// the drop via a NoticeHTTPSinkOverflow notice.
+func TestNoticeHTTPSinkOverflow(t *testing.T) {
+	defer SetNoticeOutput(io.Discard)
+
+	var buf bytes.Buffer
+	SetNoticeOutput(&buf)
+
+	sink := &noticeHTTPSink{notices: make(chan string, 2)}
+
+	sink.enqueue("Info", "a")
+	sink.enqueue("Info", "b")
+	sink.enqueue("Info", "c")
+
+	if sink.overflowCount != 1 {
+		t.Fatalf("expected overflowCount 1, got %d", sink.overflowCount)
+	}
+
+	close(sink.notices)
+	var queued []string
+	for encodedNotice := range sink.notices {
+		queued = append(queued, encodedNotice)
+	}
+	if len(queued) != 2 || queued[0] != "b" || queued[1] != "c" {
+		t.Fatalf("expected the oldest notice to be dropped, leaving [b c], got %v", queued)
+	}
+
+	lines := noticeLines(&buf)
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 NoticeHTTPSinkOverflow notice, got %d: %v", len(lines), lines)
+	}
+}
+
+// TestNoticeHTTPSinkRetrySucceeds verifies that post retries transient
+// failures and delivers the batch once the endpoint recovers.
+func TestNoticeHTTPSinkRetrySucceeds(t *testing.T) {
+	var requestCount int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requestCount, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	sink := &noticeHTTPSink{
+		config:     NoticeHTTPSinkConfig{URL: server.URL},
+		stopChan:   make(chan struct{}),
+		httpClient: &http.Client{Timeout: 5 * time.Second},
+	}
+
+	sink.post([]string{`{"noticeType":"Info"}`})
+
+	if got := atomic.LoadInt32(&requestCount); got != 3 {
+		t.Fatalf("expected 3 attempts (2 failures + 1 success), got %d", got)
+	}
+}
+
+// TestNoticeHTTPSinkStopAbortsRetry verifies that a closed stop channel
+// aborts the retry backoff promptly, rather than blocking through the
+// full backoff schedule.
+func TestNoticeHTTPSinkStopAbortsRetry(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	stopChan := make(chan struct{})
+	close(stopChan)
+
+	sink := &noticeHTTPSink{
+		config:     NoticeHTTPSinkConfig{URL: server.URL},
+		stopChan:   stopChan,
+		httpClient: &http.Client{Timeout: 5 * time.Second},
+	}
+
+	start := time.Now()
+	sink.post([]string{`{"noticeType":"Info"}`})
+	elapsed := time.Since(start)
+
+	if elapsed >= noticeHTTPSinkInitialBackoff {
+		t.Fatalf("expected post to abort before the first backoff wait (%s), took %s", noticeHTTPSinkInitialBackoff, elapsed)
+	}
+}
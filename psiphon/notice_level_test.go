@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+)
+
+// noticeLines splits captured notice output into its discrete JSON lines,
+// dropping any trailing blank line.
+func noticeLines(buf *bytes.Buffer) []string {
+	var lines []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func TestNoticeLevelGating(t *testing.T) {
+	defer SetNoticeOutput(io.Discard)
+	defer SetNoticeLevel(NoticeLevelInfo)
+
+	var buf bytes.Buffer
+	SetNoticeOutput(&buf)
+
+	// By default, NoticeLevelInfo is the gate: Debug is dropped, Info passes.
+	SetNoticeLevel(NoticeLevelInfo)
+	NoticeDebug("debug message")
+	NoticeInfo("info message")
+
+	lines := noticeLines(&buf)
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 notice at the default gate, got %d: %v", len(lines), lines)
+	}
+	var object noticeObject
+	if err := json.Unmarshal([]byte(lines[0]), &object); err != nil {
+		t.Fatalf("failed to unmarshal notice: %s", err)
+	}
+	if object.NoticeType != "Info" {
+		t.Errorf("expected the surviving notice to be Info, got %s", object.NoticeType)
+	}
+
+	// Lowering the gate to NoticeLevelDebug admits Debug notices.
+	buf.Reset()
+	SetNoticeLevel(NoticeLevelDebug)
+	NoticeDebug("debug message")
+	if len(noticeLines(&buf)) != 1 {
+		t.Errorf("expected Debug notice to pass at NoticeLevelDebug gate")
+	}
+
+	// Raising the gate to NoticeLevelError drops Info and Alert, but not Error.
+	buf.Reset()
+	SetNoticeLevel(NoticeLevelError)
+	NoticeInfo("info message")
+	NoticeAlert("alert message")
+	NoticeError("error message")
+
+	lines = noticeLines(&buf)
+	if len(lines) != 1 {
+		t.Fatalf("expected only the Error notice to pass the NoticeLevelError gate, got %d: %v", len(lines), lines)
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &object); err != nil {
+		t.Fatalf("failed to unmarshal notice: %s", err)
+	}
+	if object.NoticeType != "Error" {
+		t.Errorf("expected the surviving notice to be Error, got %s", object.NoticeType)
+	}
+	if object.Level != "Error" {
+		t.Errorf("expected the surviving notice's level field to be \"Error\", got %q", object.Level)
+	}
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+)
+
+func readActiveTunnelIPAddress(t *testing.T, buf *bytes.Buffer) string {
+	t.Helper()
+	lines := noticeLines(buf)
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 notice, got %d: %v", len(lines), lines)
+	}
+	var object noticeObject
+	if err := json.Unmarshal([]byte(lines[0]), &object); err != nil {
+		t.Fatalf("failed to unmarshal notice: %s", err)
+	}
+	var data struct {
+		IPAddress string `json:"ipAddress"`
+	}
+	if err := json.Unmarshal(object.Data, &data); err != nil {
+		t.Fatalf("failed to unmarshal notice data: %s", err)
+	}
+	return data.IPAddress
+}
+
+func TestNoticeRedactionMode(t *testing.T) {
+	defer SetNoticeOutput(io.Discard)
+	defer SetNoticeRedactionMode(false)
+	defer SetNoticeLevel(NoticeLevelInfo)
+	SetNoticeLevel(NoticeLevelInfo)
+
+	const ipAddress = "203.0.113.7"
+
+	var buf bytes.Buffer
+	SetNoticeOutput(&buf)
+
+	// In the default, "safe", redaction mode, the private field is
+	// replaced with a stable, non-reversible placeholder.
+	SetNoticeRedactionMode(false)
+	NoticeActiveTunnel(ipAddress)
+	redacted := readActiveTunnelIPAddress(t, &buf)
+	if redacted == ipAddress {
+		t.Fatalf("expected ipAddress to be redacted in safe mode, got raw value")
+	}
+	if !strings.HasPrefix(redacted, "[redacted:") {
+		t.Errorf("expected redacted value to be tagged, got %q", redacted)
+	}
+
+	// Redaction is stable: the same input always redacts to the same value.
+	buf.Reset()
+	NoticeActiveTunnel(ipAddress)
+	redactedAgain := readActiveTunnelIPAddress(t, &buf)
+	if redactedAgain != redacted {
+		t.Errorf("expected redaction to be stable, got %q then %q", redacted, redactedAgain)
+	}
+
+	// In "unsafe diagnostics" mode, the private field is emitted verbatim.
+	buf.Reset()
+	SetNoticeRedactionMode(true)
+	NoticeActiveTunnel(ipAddress)
+	unsafeValue := readActiveTunnelIPAddress(t, &buf)
+	if unsafeValue != ipAddress {
+		t.Errorf("expected ipAddress %q verbatim in unsafe mode, got %q", ipAddress, unsafeValue)
+	}
+}
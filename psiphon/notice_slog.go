@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// NewNoticeSlogHandler returns an io.Writer suitable for SetNoticeOutput
+// that parses each notice JSON object and re-emits it as a structured
+// slog.Logger record on logger. The notice's "level" field is mapped onto
+// slog.Level, "noticeType" and the "data" payload are flattened into
+// attributes, and the notice's timestamp is preserved.
+func NewNoticeSlogHandler(logger *slog.Logger) io.Writer {
+	return NewNoticeReceiver(func(notice []byte) {
+		var object noticeObject
+		if json.Unmarshal(notice, &object) != nil {
+			return
+		}
+		var data map[string]interface{}
+		_ = json.Unmarshal(object.Data, &data)
+
+		message := object.NoticeType
+		attrs := make([]slog.Attr, 0, len(data)+1)
+		attrs = append(attrs, slog.String("noticeType", object.NoticeType))
+		for name, value := range data {
+			if name == "message" {
+				if text, ok := value.(string); ok {
+					message = text
+					continue
+				}
+			}
+			attrs = append(attrs, slog.Any(name, value))
+		}
+
+		timestamp, err := time.Parse(time.RFC3339, object.Timestamp)
+		if err != nil {
+			timestamp = time.Now().UTC()
+		}
+
+		level := noticeLevelStringToSlogLevel(object.Level)
+		ctx := context.Background()
+		if !logger.Enabled(ctx, level) {
+			return
+		}
+
+		record := slog.NewRecord(timestamp, level, message, 0)
+		record.AddAttrs(attrs...)
+		_ = logger.Handler().Handle(ctx, record)
+	})
+}
+
+// RegisterNoticeSlogHandler sets logger to receive all notices, via
+// NewNoticeSlogHandler. This is a convenience wrapper around
+// SetNoticeOutput for embedders whose logging is built around log/slog.
+func RegisterNoticeSlogHandler(logger *slog.Logger) {
+	SetNoticeOutput(NewNoticeSlogHandler(logger))
+}
+
+// slogNoticeHandler implements slog.Handler by funneling records through
+// outputNotice, so host application slog.Logger calls are emitted as
+// notices alongside the rest of the notice stream.
+type slogNoticeHandler struct {
+	attrs []slog.Attr
+}
+
+// NewSlogNoticeHandler creates a slog.Handler that converts slog records
+// into notices of type "Log", via outputNotice. Use this with
+// slog.New(psiphon.NewSlogNoticeHandler()) to route host application
+// logging through the notice stream.
+func NewSlogNoticeHandler() slog.Handler {
+	return &slogNoticeHandler{}
+}
+
+func (handler *slogNoticeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return true
+}
+
+func (handler *slogNoticeHandler) Handle(ctx context.Context, record slog.Record) error {
+	args := make([]interface{}, 0, 2+2*(len(handler.attrs)+record.NumAttrs()))
+	args = append(args, "message", record.Message)
+	for _, attr := range handler.attrs {
+		args = append(args, attr.Key, attr.Value.Any())
+	}
+	record.Attrs(func(attr slog.Attr) bool {
+		args = append(args, attr.Key, attr.Value.Any())
+		return true
+	})
+	outputNotice("Log", slogLevelToNoticeLevel(record.Level), false, args...)
+	return nil
+}
+
+func (handler *slogNoticeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	merged := make([]slog.Attr, 0, len(handler.attrs)+len(attrs))
+	merged = append(merged, handler.attrs...)
+	merged = append(merged, attrs...)
+	return &slogNoticeHandler{attrs: merged}
+}
+
+func (handler *slogNoticeHandler) WithGroup(name string) slog.Handler {
+	// Grouping is not supported; attributes are flattened into the notice data.
+	return handler
+}
+
+// noticeLevelStringToSlogLevel maps a notice's "level" field, as produced
+// by outputNotice, onto the corresponding slog.Level.
+func noticeLevelStringToSlogLevel(level string) slog.Level {
+	switch level {
+	case "Debug":
+		return slog.LevelDebug
+	case "Warning":
+		return slog.LevelWarn
+	case "Error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// slogLevelToNoticeLevel maps a slog.Level onto the closest NoticeLevel.
+func slogLevelToNoticeLevel(level slog.Level) NoticeLevel {
+	switch {
+	case level < slog.LevelInfo:
+		return NoticeLevelDebug
+	case level < slog.LevelWarn:
+		return NoticeLevelInfo
+	case level < slog.LevelError:
+		return NoticeLevelWarning
+	default:
+		return NoticeLevelError
+	}
+}
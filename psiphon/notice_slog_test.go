@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// TestNoticeSlogHandlerLevelGating verifies that NewNoticeSlogHandler
+// respects the destination logger's own configured level, rather than
+// unconditionally forwarding every notice to its Handler.
+func TestNoticeSlogHandlerLevelGating(t *testing.T) {
+	defer SetNoticeOutput(io.Discard)
+	defer SetNoticeLevel(NoticeLevelInfo)
+	SetNoticeLevel(NoticeLevelDebug)
+
+	var slogOutput bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&slogOutput, &slog.HandlerOptions{Level: slog.LevelWarn}))
+
+	SetNoticeOutput(NewNoticeSlogHandler(logger))
+
+	NoticeDebug("debug message")
+	if slogOutput.Len() != 0 {
+		t.Fatalf("expected Debug notice to be gated out by the logger's Warn level, got %q", slogOutput.String())
+	}
+
+	NoticeAlert("alert message")
+	if !strings.Contains(slogOutput.String(), "alert message") {
+		t.Errorf("expected Alert notice to pass the logger's Warn level, got %q", slogOutput.String())
+	}
+}
+
+// TestNoticeSlogHandlerForwardsAttrs verifies that a passed-through
+// notice's type, message, and data fields arrive as slog attributes.
+func TestNoticeSlogHandlerForwardsAttrs(t *testing.T) {
+	defer SetNoticeOutput(io.Discard)
+	defer SetNoticeLevel(NoticeLevelInfo)
+	SetNoticeLevel(NoticeLevelInfo)
+
+	var slogOutput bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&slogOutput, nil))
+
+	SetNoticeOutput(NewNoticeSlogHandler(logger))
+
+	NoticeInfo("hello world")
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(slogOutput.Bytes(), &record); err != nil {
+		t.Fatalf("failed to unmarshal slog record: %s", err)
+	}
+	if record["msg"] != "hello world" {
+		t.Errorf("expected msg %q, got %v", "hello world", record["msg"])
+	}
+	if record["noticeType"] != "Info" {
+		t.Errorf("expected noticeType attribute %q, got %v", "Info", record["noticeType"])
+	}
+}
+
+// TestSlogNoticeHandlerEmitsNotice verifies that a slog.Logger built on
+// NewSlogNoticeHandler routes its records into the notice stream as "Log"
+// notices, carrying the message and attributes, including those added via
+// With.
+func TestSlogNoticeHandlerEmitsNotice(t *testing.T) {
+	defer SetNoticeOutput(io.Discard)
+	defer SetNoticeLevel(NoticeLevelInfo)
+	SetNoticeLevel(NoticeLevelInfo)
+
+	var buf bytes.Buffer
+	SetNoticeOutput(&buf)
+
+	logger := slog.New(NewSlogNoticeHandler())
+	logger.With("component", "test").Warn("something happened", "code", 42)
+
+	lines := noticeLines(&buf)
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 notice, got %d: %v", len(lines), lines)
+	}
+
+	var object noticeObject
+	if err := json.Unmarshal([]byte(lines[0]), &object); err != nil {
+		t.Fatalf("failed to unmarshal notice: %s", err)
+	}
+	if object.NoticeType != "Log" {
+		t.Errorf("expected noticeType %q, got %q", "Log", object.NoticeType)
+	}
+	if object.Level != "Warning" {
+		t.Errorf("expected level %q, got %q", "Warning", object.Level)
+	}
+
+	var data struct {
+		Message   string `json:"message"`
+		Component string `json:"component"`
+		Code      int    `json:"code"`
+	}
+	if err := json.Unmarshal(object.Data, &data); err != nil {
+		t.Fatalf("failed to unmarshal notice data: %s", err)
+	}
+	if data.Message != "something happened" {
+		t.Errorf("expected message %q, got %q", "something happened", data.Message)
+	}
+	if data.Component != "test" {
+		t.Errorf("expected component attribute %q, got %q", "test", data.Component)
+	}
+	if data.Code != 42 {
+		t.Errorf("expected code attribute %d, got %d", 42, data.Code)
+	}
+}
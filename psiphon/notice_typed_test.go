@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"io"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/notice"
+)
+
+// TestTypedNoticeReceiver verifies that a NoticeReceiver created with
+// NewTypedNoticeReceiver invokes both the raw-bytes callback and the
+// typed callback, with the latter receiving the concrete notice.Payload
+// registered for the notice's type.
+func TestTypedNoticeReceiver(t *testing.T) {
+	var rawNotices [][]byte
+	var typedNoticeTypes []string
+	var typedPayloads []notice.Payload
+
+	receiver := NewTypedNoticeReceiver(
+		func(rawNotice []byte) {
+			rawNotices = append(rawNotices, append([]byte(nil), rawNotice...))
+		},
+		func(noticeType string, payload notice.Payload) {
+			typedNoticeTypes = append(typedNoticeTypes, noticeType)
+			typedPayloads = append(typedPayloads, payload)
+		})
+
+	defer SetNoticeOutput(io.Discard)
+	SetNoticeOutput(receiver)
+
+	NoticeTunnels(3)
+
+	if len(rawNotices) != 1 {
+		t.Fatalf("expected 1 raw notice, got %d", len(rawNotices))
+	}
+
+	if len(typedPayloads) != 1 {
+		t.Fatalf("expected 1 typed notice, got %d", len(typedPayloads))
+	}
+	if typedNoticeTypes[0] != "Tunnels" {
+		t.Errorf("expected noticeType %q, got %q", "Tunnels", typedNoticeTypes[0])
+	}
+	tunnels, ok := typedPayloads[0].(*notice.TunnelsPayload)
+	if !ok {
+		t.Fatalf("expected *notice.TunnelsPayload, got %T", typedPayloads[0])
+	}
+	if tunnels.Count != 3 {
+		t.Errorf("expected Count 3, got %d", tunnels.Count)
+	}
+}
+
+// TestTypedNoticeReceiverUnregisteredType verifies that the typed
+// callback is skipped, while the raw callback still fires, for a notice
+// type with no payload registered in notice.Unmarshal.
+func TestTypedNoticeReceiverUnregisteredType(t *testing.T) {
+	var rawCount int
+	var typedCount int
+
+	receiver := NewTypedNoticeReceiver(
+		func(rawNotice []byte) { rawCount++ },
+		func(noticeType string, payload notice.Payload) { typedCount++ })
+
+	defer SetNoticeOutput(io.Discard)
+	SetNoticeOutput(receiver)
+
+	NoticeHTTPSinkOverflow(1)
+
+	if rawCount != 1 {
+		t.Fatalf("expected 1 raw notice, got %d", rawCount)
+	}
+	if typedCount != 0 {
+		t.Errorf("expected 0 typed notices for an unregistered notice type, got %d", typedCount)
+	}
+}